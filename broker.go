@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+-Broker lets multiple server instances share a room. Publish fans a message
+out to every subscriber of topic, whether it runs in this process or another
+one behind the same broker. Subscribe registers a handler for a topic; the
+handler may be invoked concurrently and must not block for long. Unsubscribe
+removes whatever handler is currently registered for topic, so a reconnect
+that reuses a topic (e.g. the same client id) doesn't leave a stale handler
+capturing a torn-down connection.
+*/
+type Broker interface {
+	Publish(topic string, msg []byte) error
+	Subscribe(topic string, handler func([]byte)) error
+	Unsubscribe(topic string) error
+}
+
+/*
+-localBroker is the default Broker: a single process talking to itself. It's
+what ClientManager falls back to when no external broker is configured, and
+it's enough for a single instance.
+*/
+type localBroker struct {
+	mu       sync.RWMutex
+	handlers map[string][]func([]byte)
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{handlers: make(map[string][]func([]byte))}
+}
+
+func (b *localBroker) Publish(topic string, msg []byte) error {
+	b.mu.RLock()
+	handlers := b.handlers[topic]
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(topic string, handler func([]byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handler)
+	return nil
+}
+
+func (b *localBroker) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, topic)
+	return nil
+}
+
+/*
+-natsBroker backs Broker with a NATS connection so that several server
+instances can share a room: a message published by one instance is delivered
+to every instance subscribed to the same subject.
+*/
+type natsBroker struct {
+	conn *nats.Conn
+	mu   sync.Mutex
+	subs map[string]*nats.Subscription
+}
+
+func newNatsBroker(url string) (*natsBroker, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroker{conn: conn, subs: make(map[string]*nats.Subscription)}, nil
+}
+
+func (b *natsBroker) Publish(topic string, msg []byte) error {
+	return b.conn.Publish(topic, msg)
+}
+
+func (b *natsBroker) Subscribe(topic string, handler func([]byte)) error {
+	sub, err := b.conn.Subscribe(topic, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.subs[topic] = sub
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *natsBroker) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	sub, ok := b.subs[topic]
+	delete(b.subs, topic)
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return sub.Unsubscribe()
+}
+
+// broadcastTopic is the subject every server instance publishes to for
+// messages with no Recipient; every instance subscribes to it on startup.
+const broadcastTopic = "chat.broadcast"
+
+// clientTopic is the per-recipient subject a server instance subscribes to
+// while it hosts that client, so direct messages reach whichever instance
+// the recipient is actually connected to.
+func clientTopic(id string) string {
+	return "chat.client." + id
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/gorilla/websocket"
+)
+
+/*
+-frame mirrors the server's JSON-RPC 2.0 envelope; it's redeclared here
+because this is a separate `main` package and can't import the server's.
+*/
+type frame struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *frameError     `json:"error,omitempty"`
+}
+
+type frameError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+/*
+-chatMessage mirrors the server's Message, which rides as chat.message
+frame params.
+*/
+type chatMessage struct {
+	Sender    string `json:"sender,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+// tea.Msg types driving Update
+type msgReceived struct{ frame frame }
+type msgSent struct{}
+type msgError struct{ err error }
+
+/*
+-outboundFrame is one write to be made against conn: the message type is
+carried alongside the payload so the close handshake (a control frame) and
+ordinary JSON-RPC frames (text frames) can share the same writer.
+*/
+type outboundFrame struct {
+	messageType int
+	payload     []byte
+}
+
+/*
+-model holds the websocket connection, the scrollback and input widgets, the
+channel a background goroutine feeds with raw frames read off the socket,
+and the channel the same kind of goroutine drains to make every outbound
+write. gorilla/websocket allows only one writer at a time, but bubbletea
+runs each tea.Cmd on its own goroutine and Update can also write directly
+(Ctrl-C/Esc), so every write goes through outgoing instead of calling
+conn.WriteMessage from wherever.
+*/
+type model struct {
+	viewport viewport.Model
+	input    textinput.Model
+	incoming chan []byte
+	outgoing chan outboundFrame
+	lines    []string
+	nextID   int64
+	err      error
+}
+
+func (m model) Init() tea.Cmd {
+	return tea.Batch(textinput.Blink, listenCmd(m.incoming))
+}
+
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.viewport.Width = msg.Width
+		m.viewport.Height = msg.Height - 3
+		m.input.Width = msg.Width
+		return m, nil
+
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			m.outgoing <- outboundFrame{websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")}
+			return m, tea.Quit
+		case tea.KeyEnter:
+			return m.handleSubmit()
+		}
+
+	case msgReceived:
+		m.appendLine(renderFrame(msg.frame))
+		return m, listenCmd(m.incoming)
+
+	case msgError:
+		m.err = msg.err
+		m.appendLine(fmt.Sprintf("* connection error: %v", msg.err))
+		return m, nil
+
+	case msgSent:
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m model) View() string {
+	return fmt.Sprintf("%s\n%s", m.viewport.View(), m.input.View())
+}
+
+func (m *model) appendLine(line string) {
+	m.lines = append(m.lines, line)
+	m.viewport.SetContent(strings.Join(m.lines, "\n"))
+	m.viewport.GotoBottom()
+}
+
+/*
+-handleSubmit turns the input field into an outbound frame: /dm and /list
+become the matching JSON-RPC call, /quit closes the connection, and
+anything else is a plain chat.send.
+*/
+func (m model) handleSubmit() (tea.Model, tea.Cmd) {
+	text := strings.TrimSpace(m.input.Value())
+	m.input.SetValue("")
+	if text == "" {
+		return m, nil
+	}
+
+	switch {
+	case text == "/quit":
+		m.outgoing <- outboundFrame{websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")}
+		return m, tea.Quit
+
+	case text == "/list":
+		return m, m.call("chat.list", nil)
+
+	case strings.HasPrefix(text, "/dm "):
+		rest := strings.TrimPrefix(text, "/dm ")
+		parts := strings.SplitN(rest, " ", 2)
+		if len(parts) != 2 {
+			m.appendLine("* usage: /dm <id> <text>")
+			return m, nil
+		}
+		params, _ := json.Marshal(&chatMessage{Recipient: parts[0], Content: parts[1]})
+		return m, m.call("chat.send", params)
+
+	default:
+		params, _ := json.Marshal(&chatMessage{Content: text})
+		return m, m.call("chat.send", params)
+	}
+}
+
+func (m *model) call(method string, params json.RawMessage) tea.Cmd {
+	m.nextID++
+	f := &frame{JSONRPC: "2.0", ID: &m.nextID, Method: method, Params: params}
+	outgoing := m.outgoing
+
+	return func() tea.Msg {
+		payload, err := json.Marshal(f)
+		if err != nil {
+			return msgError{err: err}
+		}
+		outgoing <- outboundFrame{websocket.TextMessage, payload}
+		return msgSent{}
+	}
+}
+
+func renderFrame(f frame) string {
+	switch f.Method {
+	case "chat.message":
+		var cm chatMessage
+		if err := json.Unmarshal(f.Params, &cm); err != nil {
+			return fmt.Sprintf("* malformed chat.message: %v", err)
+		}
+		if cm.Sender == "" {
+			return cm.Content
+		}
+		return fmt.Sprintf("%s: %s", cm.Sender, cm.Content)
+
+	case "xrpc.ch.val", "xrpc.ch.close":
+		return fmt.Sprintf("* %s %s", f.Method, string(f.Params))
+	}
+
+	if f.Error != nil {
+		return fmt.Sprintf("* error: %s", f.Error.Message)
+	}
+	if f.Result != nil {
+		return fmt.Sprintf("* %s", string(f.Result))
+	}
+	return fmt.Sprintf("* %+v", f)
+}
+
+/*
+-pump reads frames off the socket and feeds them to incoming until the
+connection drops, then closes incoming so listenCmd can report it.
+*/
+func pump(conn *websocket.Conn, incoming chan []byte) {
+	defer close(incoming)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		incoming <- data
+	}
+}
+
+/*
+-writePump is the only goroutine that ever calls conn.WriteMessage: every
+outbound write, from a chat.send tea.Cmd or from Update closing the
+connection directly, goes through outgoing instead, so two writes can never
+race on the same connection.
+*/
+func writePump(conn *websocket.Conn, outgoing <-chan outboundFrame) {
+	for out := range outgoing {
+		if err := conn.WriteMessage(out.messageType, out.payload); err != nil {
+			return
+		}
+	}
+}
+
+func listenCmd(incoming chan []byte) tea.Cmd {
+	return func() tea.Msg {
+		raw, ok := <-incoming
+		if !ok {
+			return msgError{err: fmt.Errorf("connection closed")}
+		}
+		var f frame
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return msgError{err: err}
+		}
+		return msgReceived{frame: f}
+	}
+}
+
+func main() {
+	server := flag.String("server", "ws://localhost:12345/ws", "chat server websocket URL")
+	flag.Parse()
+
+	conn, _, err := websocket.DefaultDialer.Dial(*server, nil)
+	if err != nil {
+		log.Fatalf("dial %s: %v", *server, err)
+	}
+	defer conn.Close()
+
+	ti := textinput.New()
+	ti.Placeholder = "message, or /dm <id> <text>, /list, /quit"
+	ti.Focus()
+
+	incoming := make(chan []byte)
+	go pump(conn, incoming)
+
+	outgoing := make(chan outboundFrame)
+	go writePump(conn, outgoing)
+
+	m := model{viewport: viewport.New(80, 20), input: ti, incoming: incoming, outgoing: outgoing}
+
+	if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+		log.Fatalf("run: %v", err)
+	}
+}
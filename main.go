@@ -1,34 +1,114 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
 )
 
+// methods is the process-wide JSON-RPC method registry; every connection's
+// rpcConn dispatches against it.
+var methods = NewRegistry()
+
+// liveness tuning for the websocket ping/pong keepalive
+const (
+	// writeWait is the time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// pongWait is the time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// pingPeriod sends pings to the peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// maxMessageSize is the largest message size allowed from the peer.
+	maxMessageSize = 4096
+)
+
+// session resume tuning
+const (
+	// sessionBufferSize is how many recent messages a session keeps around to
+	// replay to a reconnecting client.
+	sessionBufferSize = 1024
+
+	// sessionGrace is how long a disconnected session's replay buffer is kept
+	// before it's dropped for good.
+	sessionGrace = 30 * time.Second
+)
+
+/*
+-bufferedMessage is one entry in a session's replay buffer.
+*/
+type bufferedMessage struct {
+	seq     uint64
+	payload []byte
+}
+
+/*
+-replaySession is a session's gap-free delivery state: the next sequence
+number to hand out, the ring buffer of recently delivered messages, and,
+while the session is disconnected, the timer that will drop it after
+sessionGrace.
+*/
+type replaySession struct {
+	nextSeq   uint64
+	buffer    []bufferedMessage
+	dropTimer *time.Timer
+}
+
 /*
 -Keeps track of all connected clients
 -clients that are trying to be registered
 -clients that have been destroyed or are waiting to be removed
 -messages that are to be broadcasted between connected clients
+-clientsByID is an id -> *Client index used to route direct messages
+-broker fans messages out to every server instance sharing this room
+-serverID uniquely identifies this instance; main() assigns it and nothing
+ else reads it, so acks and presence are not routed by it
+-mu guards clients/clientsByID/sessions, which the broker's subscription
+ callbacks may touch from outside the start() goroutine
+-sessions is a session id -> replaySession index used to resume dropped
+ connections without a gap
+-workers carries task messages to be fanned out one-at-a-time, round-robin,
+ across workerIDs/workerIdx (also guarded by mu)
 */
 type ClientManager struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
+	clients     map[*Client]bool
+	clientsByID map[string]*Client
+	broadcast   chan []byte
+	register    chan *Client
+	unregister  chan *Client
+	broker      Broker
+	serverID    string
+	sessions    map[string]*replaySession
+	workers     chan []byte
+	workerIDs   []string
+	workerIdx   int
+	mu          sync.RWMutex
 }
 
 /*
 -each client has a unique ID, socket connection and a message to be sent
+-mode is "" for a normal chat client or workerMode for one in the
+round-robin task pool
+-rpc is this connection's JSON-RPC dispatcher; the unregister case reaches
+through it to cancel any in-flight calls and streams when the socket goes
+away
 */
 type Client struct {
 	id     string
 	socket *websocket.Conn
 	send   chan []byte
+	mode   string
+	rpc    *rpcConn
 }
 
 /*
@@ -38,56 +118,246 @@ type Message struct {
 	Sender    string `json: "sender,omitempty"`
 	Recipient string `json:"recipient,omitempty"`
 	Content   string `json:"content,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Type      string `json:"type,omitempty"`
 }
 
+// workerMode is the Client.mode value for a connection that joined the
+// round-robin worker pool via ?mode=worker; taskType is the Message.Type
+// that routes a message to that pool instead of broadcast/direct delivery.
+const workerMode = "worker"
+const taskType = "task"
+
 // global ClientManager
 var manager = ClientManager{
-	broadcast:  make(chan []byte),
-	register:   make(chan *Client),
-	unregister: make(chan *Client),
-	clients:    make(map[*Client]bool),
+	broadcast:   make(chan []byte),
+	register:    make(chan *Client),
+	unregister:  make(chan *Client),
+	clients:     make(map[*Client]bool),
+	clientsByID: make(map[string]*Client),
+	broker:      newLocalBroker(),
+	sessions:    make(map[string]*replaySession),
+	workers:     make(chan []byte),
+}
+
+/*
+-subscribeBroadcast hooks the manager up to the shared broadcastTopic so that
+a message published by any server instance (including this one) reaches
+every session this instance knows about — not just currently connected ones.
+Buffering has to happen for every known session regardless of whether it's
+live right now, or a session sitting in its disconnect grace window
+(armSessionGrace) would silently miss anything broadcast during that window
+and a reconnecting client would believe it was fully caught up when it
+wasn't. Call it once, after the broker is set.
+*/
+func (mn *ClientManager) subscribeBroadcast() error {
+	return mn.broker.Subscribe(broadcastTopic, func(message []byte) {
+		mn.mu.RLock()
+		ids := make([]string, 0, len(mn.sessions))
+		for id := range mn.sessions {
+			ids = append(ids, id)
+		}
+		mn.mu.RUnlock()
+
+		for _, id := range ids {
+			stamped := mn.stampAndBuffer(id, message)
+			mn.deliverLocal(id, stamped)
+		}
+	})
+}
+
+/*
+-deliverLocal sends a stamped payload straight to sessionID's live
+connection on this instance, if it has one. It's a no-op, leaving the
+message in the session's replay buffer for later, when the session is
+disconnected (still within its grace window) or hosted on another instance.
+*/
+func (mn *ClientManager) deliverLocal(sessionID string, stamped []byte) {
+	mn.mu.RLock()
+	conn, ok := mn.clientsByID[sessionID]
+	mn.mu.RUnlock()
+	if !ok {
+		return
+	}
+	select {
+	case conn.send <- stamped:
+	default:
+		// a dead/slow client; its own read/write loop will trip a ping or
+		// read deadline and unregister it.
+	}
+}
+
+/*
+-stampAndBuffer assigns the next sequence number in the named session to
+message, records it in that session's replay buffer, and returns the
+re-marshalled, stamped payload that should actually be delivered.
+*/
+func (mn *ClientManager) stampAndBuffer(sessionID string, message []byte) []byte {
+	var parsed Message
+	if err := json.Unmarshal(message, &parsed); err != nil {
+		parsed = Message{Content: string(message)}
+	}
+
+	mn.mu.Lock()
+	session, ok := mn.sessions[sessionID]
+	if !ok {
+		session = &replaySession{}
+		mn.sessions[sessionID] = session
+	}
+	session.nextSeq++
+	parsed.SessionID = sessionID
+	parsed.Seq = session.nextSeq
+	frame := marshalFrame("chat.message", &parsed)
+
+	session.buffer = append(session.buffer, bufferedMessage{seq: parsed.Seq, payload: frame})
+	if len(session.buffer) > sessionBufferSize {
+		session.buffer = session.buffer[len(session.buffer)-sessionBufferSize:]
+	}
+	mn.mu.Unlock()
+
+	return frame
+}
+
+/*
+-replaySince returns every buffered message for sessionID with a sequence
+number greater than since, in order.
+*/
+func (mn *ClientManager) replaySince(sessionID string, since uint64) [][]byte {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	session, ok := mn.sessions[sessionID]
+	if !ok {
+		return nil
+	}
+
+	var out [][]byte
+	for _, m := range session.buffer {
+		if m.seq > since {
+			out = append(out, m.payload)
+		}
+	}
+	return out
+}
+
+/*
+-replayTo sends every message buffered for conn's session since since
+straight to conn.send, letting a reconnecting client catch up gap-free.
+*/
+func (mn *ClientManager) replayTo(conn *Client, since uint64) {
+	for _, payload := range mn.replaySince(conn.id, since) {
+		conn.send <- payload
+	}
+}
+
+/*
+-armSessionGrace starts the drop timer for a session whose client just
+disconnected; if it isn't reconnected within sessionGrace, its replay buffer
+is discarded and its broker subscription torn down. Until then the
+subscription is left in place (see the register case) so anything
+published for this session while it's down still gets buffered for replay.
+*/
+func (mn *ClientManager) armSessionGrace(sessionID string) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	session, ok := mn.sessions[sessionID]
+	if !ok {
+		return
+	}
+	session.dropTimer = time.AfterFunc(sessionGrace, func() {
+		mn.mu.Lock()
+		_, stillConnected := mn.clientsByID[sessionID]
+		if !stillConnected {
+			delete(mn.sessions, sessionID)
+		}
+		mn.mu.Unlock()
+		if !stillConnected {
+			mn.broker.Unsubscribe(clientTopic(sessionID))
+		}
+	})
 }
 
 func (mn *ClientManager) start() {
 	for {
 		select {
-		/*
-			Every time the manager.register channel has data, the client will be added to the map of available clients managed by the client manager. After adding the client, a JSON message is sent to all other clients, not including the one that just connected.
-		*/
+			/*
+				Every time the manager.register channel has data, the client will be added to the map of available clients managed by the client manager. A brand new session id also gets subscribed to its own broker topic, so direct and buffered broadcast messages find it regardless of which instance it's connected to; a session resuming within its grace window keeps the subscription armSessionGrace left in place rather than getting a second one. The newly connected client is told its (possibly server-generated) session id via a session.assigned frame, so it can reconnect later with ?session=&since= and resume. After that, a JSON message is sent to all other clients, not including the one that just connected.
+			*/
 		case conn := <-mn.register:
+			mn.mu.Lock()
 			mn.clients[conn] = true
-			jsonMessage, _ := json.Marshal(&Message{Content: "/A new socket has connected"})
-			mn.send(jsonMessage, conn)
+			mn.clientsByID[conn.id] = conn
+			if conn.mode == workerMode {
+				mn.workerIDs = append(mn.workerIDs, conn.id)
+			}
+			session, resuming := mn.sessions[conn.id]
+			if resuming {
+				if session.dropTimer != nil {
+					session.dropTimer.Stop()
+					session.dropTimer = nil
+				}
+			} else {
+				mn.sessions[conn.id] = &replaySession{}
+			}
+			mn.mu.Unlock()
+			if !resuming {
+				mn.broker.Subscribe(clientTopic(conn.id), func(message []byte) {
+					stamped := mn.stampAndBuffer(conn.id, message)
+					mn.deliverLocal(conn.id, stamped)
+				})
+			}
+			conn.send <- marshalFrame("session.assigned", &Message{SessionID: conn.id})
+			mn.send(marshalFrame("chat.message", &Message{Content: "/A new socket has connected"}), conn)
 
 			/*
-				If a client disconnects for any reason, the manager.unregister channel will have data. The channel data in the disconnected client will be closed and the client will be removed from the client manager. A message announcing the disappearance of a socket will be sent to all remaining connections.
+				If a client disconnects for any reason, the manager.unregister channel will have data. The channel data in the disconnected client will be closed and the client will be removed from the client manager, and any in-flight rpc streams cancelled. Its broker subscription is left in place — armSessionGrace tears it down only once the session's grace window actually expires without a reconnect — so anything published for this session while it's down still lands in its replay buffer. A message announcing the disappearance of a socket will be sent to all remaining connections.
 			*/
 		case conn := <-mn.unregister:
-			if _, ok := mn.clients[conn]; ok {
+			mn.mu.Lock()
+			_, ok := mn.clients[conn]
+			if ok {
 				close(conn.send)
 				delete(manager.clients, conn)
-				jsonMessage, _ := json.Marshal(&Message{Content: "/A socket has disconnected"})
-				manager.send(jsonMessage, conn)
+				delete(manager.clientsByID, conn.id)
+				if conn.mode == workerMode {
+					mn.removeWorkerByID(conn.id)
+				}
+			}
+			mn.mu.Unlock()
+			if ok {
+				if conn.rpc != nil {
+					conn.rpc.cancelAll()
+				}
+				mn.armSessionGrace(conn.id)
+				manager.send(marshalFrame("chat.message", &Message{Content: "/A socket has disconnected"}), conn)
 			}
 
 			/*
-				If the manager.broadcast channel has data it means that we’re trying to send and receive messages. We want to loop through each managed client sending the message to each of them. If for some reason the channel is clogged or the message can’t be sent, we assume the client has disconnected and we remove them instead.
+				If the manager.broadcast channel has data it means that we're trying to send and receive messages. A message with a Recipient is published to that client's topic only, with an echo back to the sender's topic; everything else is published to the shared broadcastTopic so every instance, including this one, fans it out to its own clients.
 			*/
 		case message := <-mn.broadcast:
-			for conn := range mn.clients {
-				select {
-				case conn.send <- message:
-				default:
-					close(conn.send)
-					delete(mn.clients, conn)
-				}
+			var parsed Message
+			if err := json.Unmarshal(message, &parsed); err == nil && parsed.Recipient != "" {
+				mn.deliver(message, parsed)
+				continue
 			}
+			mn.broker.Publish(broadcastTopic, message)
+
+			/*
+				If the manager.workers channel has data, it's a task message to hand to exactly one worker, round-robin. A worker whose send is full or closed is skipped (and unregistered) in favor of the next one in workerIDs.
+			*/
+		case message := <-mn.workers:
+			mn.dispatchToWorker(message)
 
 		}
 	}
 }
 
 func (mn *ClientManager) send(message []byte, ignore *Client) {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
 	for conn := range mn.clients {
 		if conn != ignore {
 			conn.send <- message
@@ -95,12 +365,108 @@ func (mn *ClientManager) send(message []byte, ignore *Client) {
 	}
 }
 
+/*
+-deliver routes a direct message to the client named by parsed.Recipient and
+echoes it back to the sender by publishing to their topics. Publish always
+goes out, whether or not the recipient is known to this instance: whichever
+instance actually hosts them is subscribed to clientTopic(parsed.Recipient)
+and will deliver it locally, so checking mn.clientsByID here (a purely
+per-process map) would wrongly treat any recipient connected to another
+instance as offline.
+*/
+func (mn *ClientManager) deliver(message []byte, parsed Message) {
+	mn.broker.Publish(clientTopic(parsed.Recipient), message)
+	if parsed.Sender != parsed.Recipient {
+		mn.broker.Publish(clientTopic(parsed.Sender), message)
+	}
+}
+
+/*
+-dispatchToWorker hands message to exactly one worker, advancing the
+round-robin cursor each try. A worker that's gone, or whose send is full, is
+dropped from workerIDs and the next one in line gets a turn. A full/unready
+worker's socket is closed so its own read loop unregisters it the normal way
+(same as the ping/pong deadline does for any other dead client) rather than
+tearing down manager state directly from here.
+*/
+func (mn *ClientManager) dispatchToWorker(message []byte) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	for attempts := len(mn.workerIDs); attempts > 0 && len(mn.workerIDs) > 0; attempts-- {
+		idx := mn.workerIdx % len(mn.workerIDs)
+		id := mn.workerIDs[idx]
+		mn.workerIdx = idx + 1
+
+		conn, ok := mn.clientsByID[id]
+		if !ok {
+			// the next worker shifts into idx; point the cursor at it
+			mn.workerIdx = idx
+			mn.removeWorkerLocked(idx)
+			continue
+		}
+
+		select {
+		case conn.send <- message:
+			return
+		default:
+			conn.socket.Close()
+			mn.workerIdx = idx
+			mn.removeWorkerLocked(idx)
+		}
+	}
+}
+
+// removeWorkerLocked drops the worker at idx and keeps workerIdx pointing at
+// a valid slot (or 0 once no workers are left). Caller must hold mn.mu.
+func (mn *ClientManager) removeWorkerLocked(idx int) {
+	mn.workerIDs = append(mn.workerIDs[:idx], mn.workerIDs[idx+1:]...)
+	if len(mn.workerIDs) == 0 {
+		mn.workerIdx = 0
+	} else {
+		mn.workerIdx = mn.workerIdx % len(mn.workerIDs)
+	}
+}
+
+// removeWorkerByID drops a worker by id instead of index. Caller must hold
+// mn.mu.
+func (mn *ClientManager) removeWorkerByID(id string) {
+	for i, workerID := range mn.workerIDs {
+		if workerID == id {
+			mn.removeWorkerLocked(i)
+			return
+		}
+	}
+}
+
+/*
+-onlineIDs returns the ids of every connected client.
+*/
+func (mn *ClientManager) onlineIDs() []string {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	ids := make([]string, 0, len(mn.clientsByID))
+	for id := range mn.clientsByID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func (cli *Client) read() {
 	defer func() {
 		manager.unregister <- cli
 		cli.socket.Close()
 	}()
 
+	cli.socket.SetReadLimit(maxMessageSize)
+	cli.socket.SetReadDeadline(time.Now().Add(pongWait))
+	cli.socket.SetPongHandler(func(string) error {
+		cli.socket.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	rc := cli.rpc
+
 	for {
 		_, message, err := cli.socket.ReadMessage()
 		if err != nil {
@@ -108,25 +474,38 @@ func (cli *Client) read() {
 			cli.socket.Close()
 			break
 		}
-		jsonMessage, _ := json.Marshal(&Message{Sender: cli.id, Content: string(message)})
-		manager.broadcast <- jsonMessage
+		rc.dispatch(message)
 	}
 }
 
 func (cli *Client) write() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		cli.socket.Close()
 	}()
 
-	for message := range cli.send {
-		if err := cli.socket.WriteMessage(websocket.TextMessage, message); err != nil {
-			// Handle the error
-			fmt.Println("Error writing message to socket:", err)
-			break
+	for {
+		select {
+		case message, ok := <-cli.send:
+			cli.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				cli.socket.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := cli.socket.WriteMessage(websocket.TextMessage, message); err != nil {
+				// Handle the error
+				fmt.Println("Error writing message to socket:", err)
+				return
+			}
+
+		case <-ticker.C:
+			cli.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := cli.socket.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				return
+			}
 		}
 	}
-	cli.socket.WriteMessage(websocket.CloseMessage, []byte{})
-
 }
 
 func wsPage(res http.ResponseWriter, req *http.Request) {
@@ -136,21 +515,112 @@ func wsPage(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	uuid, err := uuid.NewV4()
-	if err != nil {
-		// Handle the error
-		fmt.Println("Error generating UUID:", err)
-		return
+	sessionID := req.URL.Query().Get("session")
+	if sessionID == "" {
+		sessionID = uuid.NewV4().String()
 	}
-	client := &Client{id: uuid.String(), socket: conn, send: make(chan []byte)}
-	manager.register <- client
 
-	go client.read()
+	var since uint64
+	if raw := req.URL.Query().Get("since"); raw != "" {
+		if parsed, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			since = parsed
+		}
+	}
+
+	client := &Client{id: sessionID, socket: conn, send: make(chan []byte), mode: req.URL.Query().Get("mode")}
+	client.rpc = newRPCConn(client, methods)
+
+	// write() must already be pumping client.send before register is sent,
+	// since the register case writes the session.assigned frame straight to
+	// it and send is unbuffered.
 	go client.write()
+	go client.read()
+
+	manager.register <- client
+	manager.replayTo(client, since)
+}
+
+/*
+-registerMethods wires up the JSON-RPC methods clients can call; chat.send is
+the old broadcast/direct-message behavior, just reached through a frame now.
+*/
+func registerMethods() {
+	methods.RegisterMethod("chat.send", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Recipient string `json:"recipient,omitempty"`
+			Content   string `json:"content"`
+			Type      string `json:"type,omitempty"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		cli, _ := ctx.Value(rpcClientKey{}).(*Client)
+		if cli == nil {
+			return nil, fmt.Errorf("chat.send: no client on context")
+		}
+
+		payload, err := json.Marshal(&Message{Sender: cli.id, Recipient: p.Recipient, Content: p.Content, Type: p.Type})
+		if err != nil {
+			return nil, err
+		}
+		if p.Type == taskType {
+			manager.workers <- payload
+		} else {
+			manager.broadcast <- payload
+		}
+		return struct {
+			OK bool `json:"ok"`
+		}{true}, nil
+	})
+
+	methods.RegisterMethod("chat.list", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return struct {
+			Online []string `json:"online"`
+		}{manager.onlineIDs()}, nil
+	})
+
+	methods.RegisterMethod("presence.subscribe", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		out := make(chan []string)
+		go func() {
+			defer close(out)
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					select {
+					case out <- manager.onlineIDs():
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+		return (<-chan []string)(out), nil
+	})
 }
 
 func main() {
 	fmt.Println("Starting application....")
+	registerMethods()
+
+	manager.serverID = uuid.NewV4().String()
+
+	if natsURL := os.Getenv("NATS_URL"); natsURL != "" {
+		broker, err := newNatsBroker(natsURL)
+		if err != nil {
+			fmt.Println("Error connecting to NATS, falling back to in-process broker:", err)
+		} else {
+			manager.broker = broker
+		}
+	}
+	if err := manager.subscribeBroadcast(); err != nil {
+		fmt.Println("Error subscribing to broadcast topic:", err)
+		return
+	}
+
 	go manager.start()
 	http.HandleFunc("ws", wsPage)
 	http.ListenAndServe(":12345", nil)
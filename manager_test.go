@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startManagerOnce sync.Once
+
+// startTestManager brings the package-global manager's goroutine and
+// broadcast subscription up exactly once, the way main() does, so tests can
+// drive it through its register/unregister/broadcast channels.
+func startTestManager() {
+	startManagerOnce.Do(func() {
+		if err := manager.subscribeBroadcast(); err != nil {
+			panic(err)
+		}
+		go manager.start()
+	})
+}
+
+// newTestClient builds a Client with no real socket, just enough to drive
+// ClientManager through its channels; send is buffered so the manager's
+// non-blocking delivery sends never drop a message the test cares about.
+func newTestClient(id string) *Client {
+	return &Client{id: id, send: make(chan []byte, 8)}
+}
+
+// readFrame reads and decodes one frame off ch, failing the test if none
+// arrives in time.
+func readFrame(t *testing.T, ch chan []byte) Frame {
+	t.Helper()
+	select {
+	case raw := <-ch:
+		var f Frame
+		if err := json.Unmarshal(raw, &f); err != nil {
+			t.Fatalf("unmarshal frame: %v", err)
+		}
+		return f
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a frame")
+		return Frame{}
+	}
+}
+
+// readChatContent reads frames off ch, skipping anything that isn't a
+// chat.message with the given content (join/leave notices, echoes meant for
+// a different assertion, etc.), until it finds one or times out.
+func readChatContent(t *testing.T, ch chan []byte, content string) Message {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case raw := <-ch:
+			var f Frame
+			if err := json.Unmarshal(raw, &f); err != nil {
+				t.Fatalf("unmarshal frame: %v", err)
+			}
+			if f.Method != "chat.message" {
+				continue
+			}
+			var m Message
+			if err := json.Unmarshal(f.Params, &m); err != nil {
+				t.Fatalf("unmarshal chat.message: %v", err)
+			}
+			if m.Content == content {
+				return m
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for chat.message %q", content)
+		}
+	}
+}
+
+/*
+-TestDirectMessageDelivery covers the direct-messaging behavior chunk0-1
+added: a Message with a Recipient reaches that recipient and echoes back to
+the sender, without being broadcast to every other connected client.
+*/
+func TestDirectMessageDelivery(t *testing.T) {
+	startTestManager()
+
+	alice := newTestClient("test-direct-alice")
+	manager.register <- alice
+	defer func() { manager.unregister <- alice }()
+	readFrame(t, alice.send) // session.assigned
+
+	bob := newTestClient("test-direct-bob")
+	manager.register <- bob
+	defer func() { manager.unregister <- bob }()
+	readFrame(t, bob.send) // session.assigned
+	readChatContent(t, alice.send, "/A new socket has connected")
+
+	payload, err := json.Marshal(&Message{Sender: alice.id, Recipient: bob.id, Content: "hi bob"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	manager.broadcast <- payload
+
+	got := readChatContent(t, bob.send, "hi bob")
+	if got.Sender != alice.id || got.Recipient != bob.id {
+		t.Fatalf("bob got %+v, want sender/recipient %s/%s", got, alice.id, bob.id)
+	}
+
+	echo := readChatContent(t, alice.send, "hi bob")
+	if echo.Sender != alice.id || echo.Recipient != bob.id {
+		t.Fatalf("alice's echo got %+v, want sender/recipient %s/%s", echo, alice.id, bob.id)
+	}
+}
+
+/*
+-TestReplayAcrossDisconnectGraceWindow covers the session-resume behavior
+chunk0-4 added: a message broadcast while a session is disconnected, but
+still inside its grace window, is buffered and delivered to that session on
+reconnect via replayTo instead of being silently dropped.
+*/
+func TestReplayAcrossDisconnectGraceWindow(t *testing.T) {
+	startTestManager()
+
+	id := "test-replay-session"
+	first := newTestClient(id)
+	manager.register <- first
+	readFrame(t, first.send) // session.assigned
+
+	manager.unregister <- first
+
+	payload, err := json.Marshal(&Message{Content: "while you were away"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	manager.broadcast <- payload
+
+	second := newTestClient(id)
+	manager.register <- second
+	defer func() { manager.unregister <- second }()
+	readFrame(t, second.send) // session.assigned
+
+	manager.replayTo(second, 0)
+
+	got := readChatContent(t, second.send, "while you were away")
+	if got.SessionID != id {
+		t.Fatalf("got session id %q, want %q", got.SessionID, id)
+	}
+}
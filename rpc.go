@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+/*
+-Frame is the JSON-RPC 2.0 envelope used for everything sent over the
+websocket: requests carry Method/Params, responses carry Result/Error, and
+server-initiated stream values reuse Method/Params too (xrpc.ch.val,
+xrpc.ch.close).
+*/
+type Frame struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *FrameError     `json:"error,omitempty"`
+}
+
+/*
+-FrameError mirrors the JSON-RPC 2.0 error object.
+*/
+type FrameError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// HandlerFunc handles one JSON-RPC method call. Returning a channel instead
+// of a plain value turns the call into a server-initiated stream: the
+// caller gets a {stream: id} result and values follow as xrpc.ch.val frames
+// until the channel closes or the caller sends xrpc.cancel.
+type HandlerFunc func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+/*
+-Registry maps method names to handlers. It's shared by every connection;
+per-connection state (in-flight calls, open streams) lives in rpcConn.
+*/
+type Registry struct {
+	mu       sync.Mutex
+	handlers map[string]HandlerFunc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]HandlerFunc)}
+}
+
+func (r *Registry) RegisterMethod(name string, fn HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[name] = fn
+}
+
+func (r *Registry) lookup(name string) (HandlerFunc, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn, ok := r.handlers[name]
+	return fn, ok
+}
+
+type rpcClientKey struct{}
+
+/*
+-rpcConn dispatches inbound frames for a single websocket connection against
+a shared Registry. handling tracks the context.CancelFunc for every in-flight
+request (by request id) so an xrpc.cancel frame, or the socket closing, can
+stop a handler or release a stream's goroutine.
+*/
+type rpcConn struct {
+	cli        *Client
+	registry   *Registry
+	handlingMu sync.Mutex
+	handling   map[int64]context.CancelFunc
+}
+
+func newRPCConn(cli *Client, registry *Registry) *rpcConn {
+	return &rpcConn{cli: cli, registry: registry, handling: make(map[int64]context.CancelFunc)}
+}
+
+// writeFrame marshals f and hands it to the connection's send loop. The
+// connection may have been torn down (cli.send closed by unregister)
+// concurrently with a stream goroutine still holding a reference to rc, so a
+// send here can race a close; recover rather than let that panic take down
+// the whole process.
+func (rc *rpcConn) writeFrame(f *Frame) {
+	f.JSONRPC = "2.0"
+	payload, _ := json.Marshal(f)
+	defer func() { recover() }()
+	rc.cli.send <- payload
+}
+
+func (rc *rpcConn) track(id int64, cancel context.CancelFunc) {
+	rc.handlingMu.Lock()
+	rc.handling[id] = cancel
+	rc.handlingMu.Unlock()
+}
+
+func (rc *rpcConn) untrack(id int64) {
+	rc.handlingMu.Lock()
+	delete(rc.handling, id)
+	rc.handlingMu.Unlock()
+}
+
+// cancelAll stops every in-flight call and stream on this connection. The
+// unregister case calls it when the underlying socket goes away, so a
+// presence.subscribe (or any other streaming handler) left open by a client
+// that disconnects without xrpc.cancel doesn't keep running against a closed
+// send channel.
+func (rc *rpcConn) cancelAll() {
+	rc.handlingMu.Lock()
+	defer rc.handlingMu.Unlock()
+	for id, cancel := range rc.handling {
+		cancel()
+		delete(rc.handling, id)
+	}
+}
+
+/*
+-dispatch parses one inbound frame and either cancels an in-flight call
+(xrpc.cancel) or routes it to the registered handler for frame.Method.
+*/
+func (rc *rpcConn) dispatch(raw []byte) {
+	var f Frame
+	if err := json.Unmarshal(raw, &f); err != nil {
+		rc.writeFrame(&Frame{Error: &FrameError{Code: -32700, Message: "parse error"}})
+		return
+	}
+
+	if f.Method == "xrpc.cancel" {
+		rc.handleCancel(f.Params)
+		return
+	}
+
+	fn, ok := rc.registry.lookup(f.Method)
+	if !ok {
+		if f.ID != nil {
+			rc.writeFrame(&Frame{ID: f.ID, Error: &FrameError{Code: -32601, Message: "method not found"}})
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), rpcClientKey{}, rc.cli))
+	if f.ID != nil {
+		rc.track(*f.ID, cancel)
+	}
+
+	go func() {
+		result, err := fn(ctx, f.Params)
+		if err != nil {
+			if f.ID != nil {
+				rc.writeFrame(&Frame{ID: f.ID, Error: &FrameError{Code: -32000, Message: err.Error()}})
+				rc.untrack(*f.ID)
+			}
+			cancel()
+			return
+		}
+
+		if v := reflect.ValueOf(result); result != nil && v.Kind() == reflect.Chan {
+			rc.stream(f.ID, v, ctx)
+			return
+		}
+
+		if f.ID != nil {
+			rc.writeFrame(&Frame{ID: f.ID, Result: result})
+			rc.untrack(*f.ID)
+		}
+		cancel()
+	}()
+}
+
+func (rc *rpcConn) handleCancel(params json.RawMessage) {
+	var p struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return
+	}
+	rc.handlingMu.Lock()
+	cancel, ok := rc.handling[p.ID]
+	rc.handlingMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+/*
+-stream pumps values out of a handler-returned channel as xrpc.ch.val
+frames, keyed by the originating request id, until the channel closes or
+ctx is cancelled (via xrpc.cancel or the connection going away). A keyed
+stream first answers the request with a {stream: id} result and always
+finishes with an xrpc.ch.close frame and releases the tracked cancel func;
+a call without a request id is dropped without reading from the channel.
+*/
+func (rc *rpcConn) stream(id *int64, ch reflect.Value, ctx context.Context) {
+	if id == nil {
+		// nothing to key the stream on; drop it without reading from it.
+		return
+	}
+
+	rc.writeFrame(&Frame{ID: id, Result: streamEnvelope{Stream: *id}})
+
+	defer func() {
+		rc.untrack(*id)
+		rc.writeFrame(&Frame{Method: "xrpc.ch.close", Params: mustMarshal(streamEnvelope{Stream: *id})})
+	}()
+
+	done := reflect.ValueOf(ctx.Done())
+	for {
+		chosen, value, ok := reflect.Select([]reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: done},
+			{Dir: reflect.SelectRecv, Chan: ch},
+		})
+		if chosen == 0 || !ok {
+			return
+		}
+		rc.writeFrame(&Frame{Method: "xrpc.ch.val", Params: mustMarshal(streamValue{Stream: *id, Value: value.Interface()})})
+	}
+}
+
+type streamEnvelope struct {
+	Stream int64 `json:"stream"`
+}
+
+type streamValue struct {
+	Stream int64       `json:"stream"`
+	Value  interface{} `json:"value"`
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage(fmt.Sprintf(`{"marshal_error":%q}`, err.Error()))
+	}
+	return raw
+}
+
+/*
+-marshalFrame wraps payload as the params of a server-initiated notification
+frame for method, e.g. the "chat.message" frames chat deliveries ride on.
+*/
+func marshalFrame(method string, payload interface{}) []byte {
+	params, _ := json.Marshal(payload)
+	frame, _ := json.Marshal(&Frame{JSONRPC: "2.0", Method: method, Params: params})
+	return frame
+}